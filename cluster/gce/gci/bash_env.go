@@ -1,7 +1,6 @@
 package gci
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,26 +8,214 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"syscall"
+	"time"
 )
 
+// CommandRunner abstracts where a shell command actually executes so the
+// configure-helper.sh tests can be pointed at something other than the
+// developer's local shell: a real GCI VM over ssh, a container built from the
+// GCI Dockerfile, or a recording fake for tests of the harness itself.
+type CommandRunner interface {
+	// Run executes cmd with args and returns its combined stdout/stderr.
+	Run(cmd string, args []string) ([]byte, error)
+	// Copy places the local file at src onto the target at dst.
+	Copy(src, dst string) error
+}
+
+// ExecRunner runs commands against the local shell via os/exec. This is the
+// behavior BashEnvironment has always had.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(cmd string, args []string) ([]byte, error) {
+	c := exec.Command("bash", "-c", addArgs(cmd, args))
+	return c.CombinedOutput()
+}
+
+func (ExecRunner) Copy(src, dst string) error {
+	return copyFile(src, dst)
+}
+
+// copyFile copies the contents of src to dst, creating or truncating dst as
+// needed.
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// SSHRunner runs commands on a remote host over ssh, e.g. a real GCI VM image
+// booted for the test.
+type SSHRunner struct {
+	Host string
+	// Args are extra flags threaded through to ssh/scp, such as an explicit
+	// -i identity file or -o StrictHostKeyChecking=no for throwaway test
+	// instances.
+	Args []string
+}
+
+func (r SSHRunner) Run(cmd string, args []string) ([]byte, error) {
+	sshArgs := append(append([]string{}, r.Args...), r.Host, addArgs(cmd, args))
+	c := exec.Command("ssh", sshArgs...)
+	return c.CombinedOutput()
+}
+
+func (r SSHRunner) Copy(src, dst string) error {
+	scpArgs := append(append([]string{}, r.Args...), src, fmt.Sprintf("%s:%s", r.Host, dst))
+	out, err := exec.Command("scp", scpArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("scp %s to %s:%s: %v: %s", src, r.Host, dst, err, out)
+	}
+	return nil
+}
+
+// DockerRunner execs inside a running container, such as one built from the
+// GCI Dockerfile, instead of the host shell.
+type DockerRunner struct {
+	Container string
+}
+
+func (r DockerRunner) Run(cmd string, args []string) ([]byte, error) {
+	c := exec.Command("docker", "exec", r.Container, "bash", "-c", addArgs(cmd, args))
+	return c.CombinedOutput()
+}
+
+func (r DockerRunner) Copy(src, dst string) error {
+	out, err := exec.Command("docker", "cp", src, fmt.Sprintf("%s:%s", r.Container, dst)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker cp %s to %s:%s: %v: %s", src, r.Container, dst, err, out)
+	}
+	return nil
+}
+
+// KindRunner is a DockerRunner pointed at a node container managed by kind,
+// so configure-helper.sh can be exercised inside a GCI-like image joined to a
+// real cluster instead of the bash mocks below.
+type KindRunner struct {
+	DockerRunner
+}
+
+// NewKindRunner resolves the first node of the named kind cluster and returns
+// a runner that execs into it.
+func NewKindRunner(cluster string) (*KindRunner, error) {
+	out, err := exec.Command("kind", "get", "nodes", "--name", cluster).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("kind get nodes --name %s: %v: %s", cluster, err, out)
+	}
+	nodes := strings.Fields(string(out))
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("kind cluster %s has no nodes", cluster)
+	}
+	return &KindRunner{DockerRunner{Container: nodes[0]}}, nil
+}
+
+// RunnerCall records a single invocation made through a FakeRunner.
+type RunnerCall struct {
+	Cmd  string
+	Args []string
+}
+
+// FakeRunner records the commands it is asked to run without touching disk,
+// for unit tests of the harness itself rather than of configure-helper.sh.
+type FakeRunner struct {
+	Calls []RunnerCall
+}
+
+func (r *FakeRunner) Run(cmd string, args []string) ([]byte, error) {
+	r.Calls = append(r.Calls, RunnerCall{Cmd: cmd, Args: args})
+	return nil, nil
+}
+
+func (r *FakeRunner) Copy(src, dst string) error {
+	r.Calls = append(r.Calls, RunnerCall{Cmd: "cp", Args: []string{src, dst}})
+	return nil
+}
+
+// MockResponse describes what a mocked command should do for one invocation:
+// what it writes to stdout/stderr and what code it exits with. ArgMatcher, if
+// set, is checked against that invocation's args in strict mode; it does not
+// affect which response is served, since the mocked shell function can't run
+// Go code to decide that.
+type MockResponse struct {
+	Stdout     string
+	Stderr     string
+	ExitCode   int
+	ArgMatcher func([]string) bool
+}
+
+// MockSpec defines a mocked command and the sequence of responses it should
+// give across successive invocations, in order. Once Responses is exhausted,
+// its last entry is repeated for any further calls. A zero-value MockSpec
+// (no Responses) behaves like the old plain-string mock: every call exits 0
+// with no output.
+type MockSpec struct {
+	Name      string
+	Responses []MockResponse
+}
+
 type MockFunc struct {
-	cmd, out string
-	calls    [][]string
+	spec  MockSpec
+	out   string
+	idx   string
+	calls [][]string
 }
 
-func (m *MockFunc) listen() {
-	// O_RDONLY without O_NONBLOCK set blocks the calling thread
-	// until a thread opens the file for writing.
-	in, _ := os.OpenFile(m.out, os.O_RDONLY, 0600)
-	var buff bytes.Buffer
-	io.Copy(&buff, in)
-	call := strings.Split(buff.String(), " ")
-	for i, a := range call {
-		call[i] = strings.Trim(a, "\n")
+// shQuote produces a double-quoted shell string literal safe to embed inside
+// the single-quoted alias definitions makeMocks builds.
+func shQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "$", "\\$", -1)
+	s = strings.Replace(s, "`", "\\`", -1)
+	s = strings.Replace(s, "'", `'\''`, -1)
+	return `"` + s + `"`
+}
+
+// responseScript renders a shell case statement that looks up the response
+// for the current call count (read from, and incremented in, an idx file
+// so the count survives invocations made in a subshell, such as inside a
+// pipeline or command substitution) and echoes its stdout and
+// stderr to the right fd before returning its code. It must use `return`,
+// not `exit`: this script runs inside the body of the mocked command's alias
+// function, and `exit` would terminate the whole `bash -c` invocation rather
+// than just reporting that command's status to its caller.
+func (m *MockFunc) responseScript() string {
+	emit := func(r MockResponse) string {
+		s := ""
+		if r.Stdout != "" {
+			s += fmt.Sprintf("printf '%%s' %s; ", shQuote(r.Stdout))
+		}
+		if r.Stderr != "" {
+			s += fmt.Sprintf("printf '%%s' %s 1>&2; ", shQuote(r.Stderr))
+		}
+		s += fmt.Sprintf("return %d ;; ", r.ExitCode)
+		return s
+	}
+
+	script := fmt.Sprintf("idx=$(cat %s 2>/dev/null || echo 0); echo $((idx+1)) > %s; case $idx in ", m.idx, m.idx)
+	for i, r := range m.spec.Responses {
+		script += fmt.Sprintf("%d) %s", i, emit(r))
+	}
+	if n := len(m.spec.Responses); n > 0 {
+		script += fmt.Sprintf("*) %s", emit(m.spec.Responses[n-1]))
+	} else {
+		script += "*) return 0 ;; "
 	}
-	m.calls = append(m.calls, call)
-	in.Close()
+	script += "esac"
+	return script
 }
 
 type source struct {
@@ -40,8 +227,33 @@ type BashEnvironment struct {
 	tmdDir    string
 	sources   []source
 	mockFuncs map[string]*MockFunc
-	pipes     []*os.File
 	cmdStr    string
+	runner    CommandRunner
+	strict    bool
+
+	// Set by WithCoverage; empty means coverage instrumentation is off.
+	coverageDir string
+	// CoverageWarning is set if coverage was requested but kcov wasn't
+	// found, so the run fell back to plain execution. Callers that want to
+	// surface it should check this after CallWithEnv and t.Log it.
+	CoverageWarning string
+}
+
+// WithCoverage opts this BashEnvironment into recording line coverage for
+// configure-helper.sh. Each CallWithEnv wraps its bash invocation with `kcov
+// --include-pattern=configure-helper.sh <dir>/<run>`, falling back to plain
+// execution (and setting CoverageWarning) if kcov isn't on PATH. dir should be
+// the same coverageDir the package's TestMain merges into a single report
+// once every test has run.
+//
+// kcov instruments the bash process directly, so coverage mode always shells
+// out locally via os/exec regardless of the configured runner: it is
+// incompatible with SSHRunner, DockerRunner, and KindRunner, none of which
+// run the script on this machine for kcov to attach to. Only use WithCoverage
+// with ExecRunner (or FakeRunner in tests that don't care about the result).
+func (b *BashEnvironment) WithCoverage(dir string) *BashEnvironment {
+	b.coverageDir = dir
+	return b
 }
 
 func addArgs(cmd string, args []string) string {
@@ -99,24 +311,144 @@ func (b *BashEnvironment) makeMocks() string {
 
 	// Echoing $@ outside of a new function includes the args from the function
 	// that is calling it.
-	mockStr := " alias %s='%s_alias(){ echo %s $@ >> %s; }; %s_alias';"
+	// Each alias definition ends its line: bash does not expand an alias on
+	// the line that defines it.
+	mockStr := " alias %s='%s_alias(){ echo %s $@ >> %s; %s; }; %s_alias';\n"
 	for cmd, m := range b.mockFuncs {
-		m.out = filepath.Join(b.tmdDir, cmd)
-		out += fmt.Sprintf(mockStr, cmd, cmd, cmd, m.out, cmd)
-		syscall.Mkfifo(m.out, 0600)
-		go m.listen()
+		m.out = filepath.Join(b.tmdDir, cmd+".calls")
+		m.idx = filepath.Join(b.tmdDir, cmd+".idx")
+		out += fmt.Sprintf(mockStr, cmd, cmd, cmd, m.out, m.responseScript(), cmd)
 	}
 	return out
 }
 
+// loadCalls reads back the call log each mock appends to and repopulates
+// MockFunc.calls from it. The log is never truncated, so after a second
+// CallWithEnv on the same BashEnvironment, calls holds the calls of both runs.
+func (b *BashEnvironment) loadCalls() {
+	for _, m := range b.mockFuncs {
+		m.calls = nil
+		data, err := ioutil.ReadFile(m.out)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(strings.Trim(string(data), "\n"), "\n") {
+			if line == "" {
+				continue
+			}
+			m.calls = append(m.calls, strings.Fields(line))
+		}
+	}
+}
+
+// checkStrict fails if strict mode is enabled and any recorded call's args
+// were rejected by the ArgMatcher of the response scheduled for it.
+func (b *BashEnvironment) checkStrict() error {
+	if !b.strict {
+		return nil
+	}
+	for cmd, m := range b.mockFuncs {
+		n := len(m.spec.Responses)
+		if n == 0 {
+			continue
+		}
+		for i, call := range m.calls {
+			// Calls past the end of Responses are served its last entry.
+			r := m.spec.Responses[n-1]
+			if i < n {
+				r = m.spec.Responses[i]
+			}
+			matcher := r.ArgMatcher
+			if matcher == nil || matcher(call[1:]) {
+				continue
+			}
+			return fmt.Errorf("strict mode: cmd %v call #%d invoked with unexpected args %v", cmd, i, call[1:])
+		}
+	}
+	return nil
+}
+
 func (b *BashEnvironment) CallWithEnv(cmd string, args []string) ([]byte, error) {
 	b.makeCMDprefix()
 	cmdStr := b.cmdStr + " " + addArgs(cmd, args)
-	c := exec.Command("bash", "-c", cmdStr)
 
+	out, err := b.run(cmdStr)
+	b.loadCalls()
+	if err != nil {
+		return out, err
+	}
+	return out, b.checkStrict()
+}
+
+// run dispatches cmdStr through kcov when coverage is enabled and available,
+// and through the configured runner otherwise. The kcov path always runs
+// bash locally via os/exec, bypassing b.runner entirely; see WithCoverage.
+func (b *BashEnvironment) run(cmdStr string) ([]byte, error) {
+	if b.coverageDir == "" {
+		return b.runner.Run(cmdStr, nil)
+	}
+
+	kcovPath, err := exec.LookPath("kcov")
+	if err != nil {
+		b.CoverageWarning = "kcov not found on PATH; running without coverage instrumentation"
+		return b.runner.Run(cmdStr, nil)
+	}
+
+	runDir := filepath.Join(b.coverageDir, fmt.Sprintf("run-%d", time.Now().UnixNano()))
+	if err := os.MkdirAll(runDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create coverage run directory %s: %v", runDir, err)
+	}
+	c := exec.Command(kcovPath, "--include-pattern=configure-helper.sh", runDir, "bash", "-c", cmdStr)
 	return c.CombinedOutput()
 }
 
+// AssertCallCount fails if cmd was not called exactly want times.
+func (b *BashEnvironment) AssertCallCount(cmd string, want int) error {
+	mock, ok := b.mockFuncs[cmd]
+	if !ok {
+		return fmt.Errorf("cmd %v not mocked", cmd)
+	}
+	if got := len(mock.calls); got != want {
+		return fmt.Errorf("cmd %v called %d time(s), want %d", cmd, got, want)
+	}
+	return nil
+}
+
+// AssertNthCalledWith fails unless cmd's nth call (0-indexed) was made with
+// exactly args.
+func (b *BashEnvironment) AssertNthCalledWith(cmd string, n int, args []string) error {
+	mock, ok := b.mockFuncs[cmd]
+	if !ok {
+		return fmt.Errorf("cmd %v not mocked", cmd)
+	}
+	if n < 0 || n >= len(mock.calls) {
+		return fmt.Errorf("cmd %v called %d time(s), no call #%d", cmd, len(mock.calls), n)
+	}
+	want := append([]string{cmd}, args...)
+	got := mock.calls[n]
+	if len(got) != len(want) {
+		return fmt.Errorf("cmd %v call #%d invoked with %v, want %v", cmd, n, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			return fmt.Errorf("cmd %v call #%d invoked with %v, want %v", cmd, n, got, want)
+		}
+	}
+	return nil
+}
+
+// AssertNotCalled fails if cmd was invoked at all.
+func (b *BashEnvironment) AssertNotCalled(cmd string) error {
+	mock, ok := b.mockFuncs[cmd]
+	if !ok {
+		return fmt.Errorf("cmd %v not mocked", cmd)
+	}
+	if len(mock.calls) > 0 {
+		return fmt.Errorf("cmd %v called %d time(s), want 0", cmd, len(mock.calls))
+	}
+	return nil
+}
+
 func (b *BashEnvironment) makeCMDprefix() {
 	// shopt -s expand_aliases needs to be first or aliases won't be expanded, hence this ordering.
 	cmdStr := b.makeMocks()
@@ -124,11 +456,18 @@ func (b *BashEnvironment) makeCMDprefix() {
 	b.cmdStr = cmdStr
 }
 
-func BashEnv(env, dir string, sources []source, mocks []string) BashEnvironment {
+// BashEnv builds a BashEnvironment that sources the given files and aliases
+// the given mocks before invoking the command under test through runner. Pass
+// ExecRunner{} for the existing local-shell behavior; pass an SSHRunner,
+// DockerRunner, or KindRunner to exercise the same table-driven tests against
+// a real GCI VM image or a container built from the GCI Dockerfile instead.
+// When strict is true, CallWithEnv fails if a mock is invoked with args its
+// scheduled response's ArgMatcher rejects.
+func BashEnv(env, dir string, sources []source, mocks []MockSpec, runner CommandRunner, strict bool) BashEnvironment {
 	mocked := make(map[string]*MockFunc)
-	for _, mock := range mocks {
-		mocked[mock] = &MockFunc{
-			cmd:   mock,
+	for _, spec := range mocks {
+		mocked[spec.Name] = &MockFunc{
+			spec:  spec,
 			calls: [][]string{},
 		}
 	}
@@ -137,6 +476,8 @@ func BashEnv(env, dir string, sources []source, mocks []string) BashEnvironment
 		tmdDir:    tmpDir,
 		sources:   sources,
 		mockFuncs: mocked,
+		runner:    runner,
+		strict:    strict,
 	}
 
 	return b
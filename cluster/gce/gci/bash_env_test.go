@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gci
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMockResponses exercises the part of MockSpec/MockResponse that
+// TestPrepareLogFile's all-defaults mock never touches: scripted non-zero
+// exit codes and stdout/stderr, call-count/call-args assertions, and strict
+// mode with ArgMatchers that accept every call (rejection is covered by
+// TestMockResponsesStrictModeRejectsUnexpectedArgs).
+func TestMockResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bash-env-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+
+	mocks := []MockSpec{
+		{
+			Name: "chown",
+			Responses: []MockResponse{
+				{
+					ExitCode:   1,
+					Stderr:     "chown: boom",
+					ArgMatcher: func(args []string) bool { return reflect.DeepEqual(args, []string{"a", "b"}) },
+				},
+				{
+					ExitCode:   0,
+					ArgMatcher: func(args []string) bool { return reflect.DeepEqual(args, []string{"c", "d"}) },
+				},
+			},
+		},
+		{Name: "usermod"},
+	}
+
+	b := BashEnv("", dir, nil, mocks, ExecRunner{}, true)
+
+	script := `chown a b; ec=$?; if [ $ec -ne 0 ]; then echo "handled: $ec"; fi; chown c d; echo done`
+	out, err := b.CallWithEnv(script, nil)
+	if err != nil {
+		t.Fatalf("CallWithEnv failed: %v\n%s", err, out)
+	}
+
+	output := string(out)
+	if !strings.Contains(output, "handled: 1") {
+		t.Errorf("expected the failing chown's error branch to run, got:\n%s", output)
+	}
+	if !strings.Contains(output, "chown: boom") {
+		t.Errorf("expected the first response's stderr to be surfaced, got:\n%s", output)
+	}
+	if !strings.Contains(output, "done") {
+		t.Errorf("expected the script to keep running after the failing chown, got:\n%s", output)
+	}
+
+	if err := b.AssertCallCount("chown", 2); err != nil {
+		t.Errorf("AssertCallCount: %v", err)
+	}
+	if err := b.AssertNthCalledWith("chown", 0, []string{"a", "b"}); err != nil {
+		t.Errorf("AssertNthCalledWith(0): %v", err)
+	}
+	if err := b.AssertNthCalledWith("chown", 1, []string{"c", "d"}); err != nil {
+		t.Errorf("AssertNthCalledWith(1): %v", err)
+	}
+	if err := b.AssertNotCalled("usermod"); err != nil {
+		t.Errorf("AssertNotCalled: %v", err)
+	}
+}
+
+// TestMockResponsesStrictModeRejectsUnexpectedArgs confirms strict mode fails
+// the call when a mock is invoked with args its scheduled response's
+// ArgMatcher rejects.
+func TestMockResponsesStrictModeRejectsUnexpectedArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bash-env-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+
+	mocks := []MockSpec{
+		{
+			Name: "chown",
+			Responses: []MockResponse{
+				{ArgMatcher: func(args []string) bool { return reflect.DeepEqual(args, []string{"root:root", "/var/log/foo"}) }},
+			},
+		},
+	}
+
+	b := BashEnv("", dir, nil, mocks, ExecRunner{}, true)
+	if _, err := b.CallWithEnv("chown unexpected args", nil); err == nil {
+		t.Fatal("expected strict mode to reject the unexpected args, got nil error")
+	}
+}
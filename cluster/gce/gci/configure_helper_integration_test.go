@@ -0,0 +1,94 @@
+//go:build integration
+// +build integration
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gci
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+// TestManifestsRunOnKind boots a kind cluster, runs configure-helper.sh
+// against a GCI-like container joined to it, and confirms kubelet actually
+// accepts the generated static pod manifests rather than just that they
+// decode as YAML. Run with `go test -tags integration` once kind and a GCI
+// node image are available; it's skipped from the normal unit test run.
+func TestManifestsRunOnKind(t *testing.T) {
+	manifests := []struct {
+		manifest string
+		funcName string
+		pod      string
+		ns       string
+	}{
+		{manifest: "kube-apiserver.manifest", funcName: "start-kube-apiserver", pod: "kube-apiserver", ns: "kube-system"},
+		{manifest: "kube-scheduler.manifest", funcName: "start-kube-scheduler", pod: "kube-scheduler", ns: "kube-system"},
+	}
+
+	harness := NewKindHarness("configure-helper-it")
+	if err := harness.Start(); err != nil {
+		t.Fatalf("Failed to start kind cluster: %v", err)
+	}
+	defer harness.Stop()
+
+	for _, m := range manifests {
+		t.Run(m.manifest, func(t *testing.T) {
+			f := newManifestFixture(t, m.manifest, m.funcName, nil, harness.runner)
+			defer f.tearDown()
+
+			f.mustInvokeFunc(`readonly KUBE_HOME={{.KubeHome}}`, kubeEnv{KubeHome: f.kubeHome})
+			f.mustLoadPodFromManifest()
+
+			pod, err := harness.LoadManifest(f, m.ns, m.pod, 2*time.Minute)
+			if err != nil {
+				t.Fatalf("kubelet never ran %s: %v", m.manifest, err)
+			}
+
+			live := containerSignatures(pod.Spec.Containers)
+			want := containerSignatures(f.pod.Spec.Containers)
+			if !reflect.DeepEqual(live, want) {
+				t.Errorf("live containers for %s diverged from decoded template:\nlive: %+v\ntemplate: %+v", m.manifest, live, want)
+			}
+		})
+	}
+}
+
+// containerSignature is the subset of a container's spec that a real API
+// server leaves untouched: it deliberately excludes everything server-side
+// defaulting or admission adds (nodeName, injected service-account volumes
+// and mounts, resolved image digests, default RestartPolicy/DNSPolicy, and
+// so on), so it's safe to compare a live pod against its decoded manifest
+// template. A full reflect.DeepEqual on PodSpec can essentially never pass:
+// the live spec always carries fields the static template never sets.
+type containerSignature struct {
+	Name    string
+	Image   string
+	Command []string
+	Args    []string
+}
+
+func containerSignatures(containers []v1.Container) []containerSignature {
+	sigs := make([]containerSignature, 0, len(containers))
+	for _, c := range containers {
+		sigs = append(sigs, containerSignature{Name: c.Name, Image: c.Image, Command: c.Command, Args: c.Args})
+	}
+	return sigs
+}
@@ -17,18 +17,20 @@ limitations under the License.
 package gci
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"testing"
 	"text/template"
 
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/diff"
 	"k8s.io/kubernetes/pkg/api/legacyscheme"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -36,155 +38,213 @@ const (
 	configureHelperScriptName = "configure-helper.sh"
 )
 
-type ManifestTestCase struct {
+var updateGolden = flag.Bool("update", false, "update golden files instead of comparing against them")
+
+// FixtureMode selects what a Fixture sets up and how tests built on it assert
+// their results.
+type FixtureMode int
+
+const (
+	// ManifestMode copies a manifest template (and any aux manifests) into
+	// KUBE_HOME before configure-helper.sh runs, so the test can load and
+	// assert on the static pod it renders.
+	ManifestMode FixtureMode = iota
+	// FuncMode runs bare: KUBE_HOME exists with nothing but an env script,
+	// so the test can invoke a single bash function, typically through a
+	// BashEnvironment with mocked commands.
+	FuncMode
+)
+
+// Fixture is the shared scaffolding behind both kinds of configure-helper.sh
+// test: a KUBE_HOME tree with an env script, plus whatever Mode adds on top.
+type Fixture struct {
+	mode FixtureMode
+	t    *testing.T
+
+	kubeHome      string
+	envScriptPath string
+	funcName      string
+	runner        CommandRunner
+
+	// Set only in ManifestMode.
 	pod                 v1.Pod
-	envScriptPath       string
 	manifest            string
 	auxManifests        []string
-	kubeHome            string
 	manifestSources     string
 	manifestDestination string
 	manifestTemplateDir string
 	manifestTemplate    string
-	manifestFuncName    string
-	t                   *testing.T
 }
 
-func newManifestTestCase(t *testing.T, manifest, funcName string, auxManifests []string) *ManifestTestCase {
-	c := &ManifestTestCase{
-		t:                t,
-		manifest:         manifest,
-		auxManifests:     auxManifests,
-		manifestFuncName: funcName,
+func newFixture(t *testing.T, mode FixtureMode, manifest, funcName string, auxManifests []string, runner CommandRunner) *Fixture {
+	f := &Fixture{
+		t:            t,
+		mode:         mode,
+		manifest:     manifest,
+		auxManifests: auxManifests,
+		funcName:     funcName,
+		runner:       runner,
 	}
 
 	d, err := ioutil.TempDir("", "configure-helper-test")
 	if err != nil {
-		c.t.Fatalf("Failed to create temp directory: %v", err)
+		f.t.Fatalf("Failed to create temp directory: %v", err)
 	}
+	f.kubeHome = d
+	f.envScriptPath = filepath.Join(f.kubeHome, envScriptFileName)
 
-	c.kubeHome = d
-	c.envScriptPath = filepath.Join(c.kubeHome, envScriptFileName)
-	c.manifestSources = filepath.Join(c.kubeHome, "kube-manifests", "kubernetes", "gci-trusty")
+	if mode == ManifestMode {
+		f.manifestSources = filepath.Join(f.kubeHome, "kube-manifests", "kubernetes", "gci-trusty")
 
-	currentPath, err := os.Getwd()
-	if err != nil {
-		c.t.Fatalf("Failed to get current directory: %v", err)
+		currentPath, err := os.Getwd()
+		if err != nil {
+			f.t.Fatalf("Failed to get current directory: %v", err)
+		}
+		gceDir := filepath.Dir(currentPath)
+		f.manifestTemplateDir = filepath.Join(gceDir, "manifests")
+		f.manifestTemplate = filepath.Join(f.manifestTemplateDir, f.manifest)
+		f.manifestDestination = filepath.Join(f.kubeHome, "etc", "kubernetes", "manifests", f.manifest)
+
+		f.mustCopyFromTemplate()
+		f.mustCopyAuxFromTemplate()
+		f.mustCreateManifestDstDir()
 	}
-	gceDir := filepath.Dir(currentPath)
-	c.manifestTemplateDir = filepath.Join(gceDir, "manifests")
-	c.manifestTemplate = filepath.Join(c.manifestTemplateDir, c.manifest)
-	c.manifestDestination = filepath.Join(c.kubeHome, "etc", "kubernetes", "manifests", c.manifest)
 
-	c.mustCopyFromTemplate()
-	c.mustCopyAuxFromTemplate()
-	c.mustCreateManifestDstDir()
+	return f
+}
 
-	return c
+// newManifestFixture sets up KUBE_HOME with manifest (and any auxManifests)
+// copied in from cluster/gce/manifests, ready for a test that invokes
+// funcName and then loads the static pod it renders.
+func newManifestFixture(t *testing.T, manifest, funcName string, auxManifests []string, runner CommandRunner) *Fixture {
+	return newFixture(t, ManifestMode, manifest, funcName, auxManifests, runner)
 }
 
-func (c *ManifestTestCase) mustCopyFromTemplate() {
-	if err := os.MkdirAll(c.manifestSources, os.ModePerm); err != nil {
-		c.t.Fatalf("Failed to create source directory: %v", err)
+// newFuncFixture sets up a bare KUBE_HOME for a test that invokes funcName
+// directly, typically through a BashEnvironment with mocked commands.
+func newFuncFixture(t *testing.T, funcName string, runner CommandRunner) *Fixture {
+	return newFixture(t, FuncMode, "", funcName, nil, runner)
+}
+
+func (f *Fixture) mustCopyFromTemplate() {
+	if err := os.MkdirAll(f.manifestSources, os.ModePerm); err != nil {
+		f.t.Fatalf("Failed to create source directory: %v", err)
 	}
 
-	if err := copyFile(c.manifestTemplate, filepath.Join(c.manifestSources, c.manifest)); err != nil {
-		c.t.Fatalf("Failed to copy source manifest to KUBE_HOME: %v", err)
+	if err := copyFile(f.manifestTemplate, filepath.Join(f.manifestSources, f.manifest)); err != nil {
+		f.t.Fatalf("Failed to copy source manifest to KUBE_HOME: %v", err)
 	}
 }
 
-func (c *ManifestTestCase) mustCopyAuxFromTemplate() {
-	for _, m := range c.auxManifests {
-		err := copyFile(filepath.Join(c.manifestTemplateDir, m), filepath.Join(c.manifestSources, m))
+func (f *Fixture) mustCopyAuxFromTemplate() {
+	for _, m := range f.auxManifests {
+		err := copyFile(filepath.Join(f.manifestTemplateDir, m), filepath.Join(f.manifestSources, m))
 		if err != nil {
-			c.t.Fatalf("Failed to copy source manifest %s to KUBE_HOME: %v", m, err)
+			f.t.Fatalf("Failed to copy source manifest %s to KUBE_HOME: %v", m, err)
 		}
 	}
 }
 
-func (c *ManifestTestCase) mustCreateManifestDstDir() {
-	p := filepath.Join(filepath.Join(c.kubeHome, "etc", "kubernetes", "manifests"))
+func (f *Fixture) mustCreateManifestDstDir() {
+	p := filepath.Join(filepath.Join(f.kubeHome, "etc", "kubernetes", "manifests"))
 	if err := os.MkdirAll(p, os.ModePerm); err != nil {
-		c.t.Fatalf("Failed to create designation folder for kube-apiserver.manifest: %v", err)
+		f.t.Fatalf("Failed to create designation folder for kube-apiserver.manifest: %v", err)
 	}
 }
 
-func (c *ManifestTestCase) mustCreateEnv(envTemplate string, env interface{}) {
-	f, err := os.Create(filepath.Join(c.kubeHome, envScriptFileName))
+func (f *Fixture) mustCreateEnv(envTemplate string, env interface{}) {
+	file, err := os.Create(filepath.Join(f.kubeHome, envScriptFileName))
 	if err != nil {
-		c.t.Fatalf("Failed to create envScript: %v", err)
+		f.t.Fatalf("Failed to create envScript: %v", err)
 	}
-	defer f.Close()
+	defer file.Close()
 
 	t := template.Must(template.New("env").Parse(envTemplate))
 
-	if err = t.Execute(f, env); err != nil {
-		c.t.Fatalf("Failed to execute template: %v", err)
+	if err = t.Execute(file, env); err != nil {
+		f.t.Fatalf("Failed to execute template: %v", err)
 	}
 }
 
-func (c *ManifestTestCase) mustInvokeFunc(envTemplate string, env interface{}) {
-	c.mustCreateEnv(envTemplate, env)
-	args := fmt.Sprintf("source %s ; source %s --source-only ; %s", c.envScriptPath, configureHelperScriptName, c.manifestFuncName)
-	cmd := exec.Command("bash", "-c", args)
+func (f *Fixture) mustInvokeFunc(envTemplate string, env interface{}) {
+	f.mustCreateEnv(envTemplate, env)
+	args := fmt.Sprintf("source %s ; source %s --source-only ; %s", f.envScriptPath, configureHelperScriptName, f.funcName)
 
-	bs, err := cmd.CombinedOutput()
+	bs, err := f.runner.Run(args, nil)
 	if err != nil {
-		c.t.Logf("%s", bs)
-		c.t.Fatalf("Failed to run configure-helper.sh: %v", err)
+		f.t.Logf("%s", bs)
+		f.t.Fatalf("Failed to run configure-helper.sh: %v", err)
 	}
-	c.t.Logf("%s", string(bs))
+	f.t.Logf("%s", string(bs))
 }
 
-func (c *ManifestTestCase) mustLoadPodFromManifest() {
-	json, err := ioutil.ReadFile(c.manifestDestination)
+func (f *Fixture) mustLoadPodFromManifest() {
+	json, err := ioutil.ReadFile(f.manifestDestination)
 	if err != nil {
-		c.t.Fatalf("Failed to read manifest: %s, %v", c.manifestDestination, err)
+		f.t.Fatalf("Failed to read manifest: %s, %v", f.manifestDestination, err)
 	}
 
-	if err := runtime.DecodeInto(legacyscheme.Codecs.UniversalDecoder(), json, &c.pod); err != nil {
-		c.t.Fatalf("Failed to decode manifest:\n%s\nerror: %v", json, err)
+	if err := runtime.DecodeInto(legacyscheme.Codecs.UniversalDecoder(), json, &f.pod); err != nil {
+		f.t.Fatalf("Failed to decode manifest:\n%s\nerror: %v", json, err)
 	}
 }
 
-func (c *ManifestTestCase) tearDown() {
-	os.RemoveAll(c.kubeHome)
-}
+// AssertManifestGolden loads the rendered manifest, decodes it, and compares
+// its canonical YAML form against testdata/golden/<manifest>_<caseName>.yaml,
+// failing with the output of Diff on mismatch. Run `go test -update` to write (or
+// rewrite) the golden file from the current output instead of comparing
+// against it.
+func (f *Fixture) AssertManifestGolden(caseName string) {
+	f.mustLoadPodFromManifest()
 
-func copyFile(src, dst string) (err error) {
-	in, err := os.Open(src)
+	got, err := yaml.Marshal(&f.pod)
 	if err != nil {
-		return err
+		f.t.Fatalf("Failed to marshal rendered pod as YAML: %v", err)
+	}
+
+	f.compareGolden(fmt.Sprintf("%s_%s.yaml", f.manifest, caseName), got)
+}
+
+// compareGolden is the comparison half of AssertManifestGolden, split out so
+// it can be unit-tested against fixed bytes without needing a real manifest
+// template and the legacyscheme defaulting that decoding one pulls in. It
+// compares got against testdata/golden/name, failing with the output of Diff
+// on mismatch, or writing got as the new golden content when -update is passed.
+func (f *Fixture) compareGolden(name string, got []byte) {
+	golden := filepath.Join("testdata", "golden", name)
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(golden), os.ModePerm); err != nil {
+			f.t.Fatalf("Failed to create golden directory: %v", err)
+		}
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			f.t.Fatalf("Failed to write golden file %s: %v", golden, err)
+		}
+		return
 	}
-	defer in.Close()
-	out, err := os.Create(dst)
+
+	want, err := ioutil.ReadFile(golden)
 	if err != nil {
-		return err
+		f.t.Fatalf("Failed to read golden file %s (run with -update to create it): %v", golden, err)
+	}
+	if !bytes.Equal(got, want) {
+		f.t.Errorf("content does not match golden file %s:\n%s", golden, Diff(string(want), string(got)))
 	}
-	defer func() {
-		cerr := out.Close()
-		if cerr == nil {
-			err = cerr
-		}
-	}()
-	_, err = io.Copy(out, in)
-	return err
 }
 
-type kubeEnv struct {
-	KubeHome string
+// Diff returns a human-readable diff between want and got for use in test
+// failure messages, as produced by diff.StringDiff: the common prefix of the
+// two, followed by the remainder of want and the remainder of got. It is not
+// a line-by-line unified diff.
+func Diff(want, got string) string {
+	return diff.StringDiff(want, got)
 }
 
-type funcTestCase struct {
-	*ManifestTestCase
+func (f *Fixture) tearDown() {
+	os.RemoveAll(f.kubeHome)
 }
 
-// TODO(mwwolters) ManifestTestCase and funcTestCase should be refactored to share a base struct
-// to share functionality but have different uses.
-func newFuncTestCase(t *testing.T, manifest, apiFunc string) *funcTestCase {
-	return &funcTestCase{
-		ManifestTestCase: newManifestTestCase(t, manifest, apiFunc, nil),
-	}
+type kubeEnv struct {
+	KubeHome string
 }
 
 func TestPrepareLogFile(t *testing.T) {
@@ -281,26 +341,26 @@ func TestPrepareLogFile(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
-			c := newFuncTestCase(t, "kube-apiserver.manifest", "prepare-log-file")
+			f := newFuncFixture(t, "prepare-log-file", ExecRunner{})
 			e := kubeEnv{
-				KubeHome: c.kubeHome,
+				KubeHome: f.kubeHome,
 			}
-			c.mustCreateEnv(tc.env, e)
-			defer c.tearDown()
+			f.mustCreateEnv(tc.env, e)
+			defer f.tearDown()
 
-			file := filepath.Join(c.kubeHome, "plf_test.log")
+			file := filepath.Join(f.kubeHome, "plf_test.log")
 			fArgs := append([]string{file}, tc.fArgs...)
 
 			sources := []source{
-				{name: c.envScriptPath},
+				{name: f.envScriptPath},
 				{name: configureHelperScriptName, sourceOnly: true},
 			}
 
-			b := BashEnv(tc.env, c.kubeHome, sources, []string{"chown"})
+			b := BashEnv(tc.env, f.kubeHome, sources, []MockSpec{{Name: "chown"}}, ExecRunner{}, false)
 			bs, err := b.CallWithEnv("prepare-log-file", fArgs)
 			if err != nil {
-				c.t.Logf("%s", bs)
-				c.t.Fatalf("Failed to run configure-helper.sh: %v", err)
+				f.t.Logf("%s", bs)
+				f.t.Fatalf("Failed to run configure-helper.sh: %v", err)
 			}
 
 			if _, err := os.Stat(file); os.IsNotExist(err) {
@@ -313,8 +373,19 @@ func TestPrepareLogFile(t *testing.T) {
 			}
 			err = b.AssertCalledWith("chown", expArgs)
 			if err != nil {
-				c.t.Fatalf("Assertion error: %v\ncalls: %v", err, *b.mockFuncs["chown"])
+				f.t.Fatalf("Assertion error: %v\ncalls: %v", err, *b.mockFuncs["chown"])
 			}
 		})
 	}
 }
+
+// TestCompareGolden exercises the golden-file comparison AssertManifestGolden
+// is built on against fixed bytes and a checked-in golden file. It doesn't go
+// through ManifestMode's own manifest-template setup (mustCopyFromTemplate
+// et al.), since that requires the real templates under cluster/gce/manifests
+// that aren't part of this checkout; the decode step those templates feed is
+// already exercised by mustLoadPodFromManifest in the kind integration suite.
+func TestCompareGolden(t *testing.T) {
+	f := &Fixture{t: t}
+	f.compareGolden("harness_sample.yaml", []byte("containers:\n- image: busybox\n  name: busybox\n"))
+}
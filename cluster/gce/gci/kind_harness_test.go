@@ -0,0 +1,101 @@
+//go:build integration
+// +build integration
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gci
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/kubernetes/pkg/api/legacyscheme"
+)
+
+// KindHarness drives a kind cluster so configure-helper.sh's generated static
+// pod manifests can be verified against a real kubelet instead of only
+// decoded as YAML: Start boots the cluster, LoadManifest copies a manifest
+// into the GCI-like node container and waits for kubelet to run it, and Stop
+// tears the cluster down again.
+type KindHarness struct {
+	cluster string
+	runner  *KindRunner
+}
+
+// NewKindHarness returns a harness for a kind cluster with the given name.
+// The cluster is not created until Start is called.
+func NewKindHarness(cluster string) *KindHarness {
+	return &KindHarness{cluster: cluster}
+}
+
+// Start creates the kind cluster and resolves a runner for its node.
+func (k *KindHarness) Start() error {
+	if out, err := exec.Command("kind", "create", "cluster", "--name", k.cluster).CombinedOutput(); err != nil {
+		return fmt.Errorf("kind create cluster --name %s: %v: %s", k.cluster, err, out)
+	}
+	runner, err := NewKindRunner(k.cluster)
+	if err != nil {
+		return err
+	}
+	k.runner = runner
+	return nil
+}
+
+// Stop deletes the kind cluster.
+func (k *KindHarness) Stop() error {
+	out, err := exec.Command("kind", "delete", "cluster", "--name", k.cluster).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("kind delete cluster --name %s: %v: %s", k.cluster, err, out)
+	}
+	return nil
+}
+
+// LoadManifest copies f's rendered manifest onto the node container's static
+// pod path, waits for kubelet to report it ready, and returns the resulting
+// pod as reported by the API server so the caller can diff it against the
+// decoded template.
+func (k *KindHarness) LoadManifest(f *Fixture, namespace, name string, timeout time.Duration) (*v1.Pod, error) {
+	if err := k.runner.Copy(f.manifestDestination, "/etc/kubernetes/manifests/"+f.manifest); err != nil {
+		return nil, err
+	}
+	if err := k.WaitReady(namespace, name, timeout); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("kubectl", "--context", "kind-"+k.cluster, "get", "pod", name, "-n", namespace, "-o", "yaml").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("kubectl get pod %s/%s: %v: %s", namespace, name, err, out)
+	}
+	pod := &v1.Pod{}
+	if err := runtime.DecodeInto(legacyscheme.Codecs.UniversalDecoder(), out, pod); err != nil {
+		return nil, fmt.Errorf("failed to decode pod %s/%s:\n%s\nerror: %v", namespace, name, out, err)
+	}
+	return pod, nil
+}
+
+// WaitReady blocks until kubelet reports the named pod ready, or timeout
+// elapses.
+func (k *KindHarness) WaitReady(namespace, name string, timeout time.Duration) error {
+	out, err := exec.Command("kubectl", "--context", "kind-"+k.cluster, "wait", "pod/"+name,
+		"-n", namespace, "--for=condition=Ready", fmt.Sprintf("--timeout=%s", timeout)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("kubectl wait pod/%s: %v: %s", name, err, out)
+	}
+	return nil
+}